@@ -3,268 +3,423 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/lxn/win"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
+// pdh.dll doesn't expose PdhCollectQueryDataWithTime through lxn/win, and the
+// function is only present on Windows Vista / Server 2008 and newer, so it is
+// resolved lazily rather than imported like the rest of the PDH API.
+var (
+	modPdh                          = syscall.NewLazyDLL("pdh.dll")
+	procPdhCollectQueryDataWithTime = modPdh.NewProc("PdhCollectQueryDataWithTime")
+
+	// pdhSupportsCollectQueryDataWithTime reports whether the current OS exposes
+	// PdhCollectQueryDataWithTime. It is false on pre-Vista systems.
+	pdhSupportsCollectQueryDataWithTime = procPdhCollectQueryDataWithTime.Find() == nil
+)
+
+// pdhCollectQueryDataWithTime wraps the PdhCollectQueryDataWithTime API, returning
+// the PDH return code and the FILETIME at which the query's counters were sampled.
+func pdhCollectQueryDataWithTime(hQuery win.PDH_HQUERY) (uint32, time.Time) {
+	var filetime int64
+	r, _, _ := procPdhCollectQueryDataWithTime.Call(uintptr(hQuery), uintptr(unsafe.Pointer(&filetime)))
+	ft := syscall.Filetime{LowDateTime: uint32(filetime), HighDateTime: uint32(filetime >> 32)}
+	return uint32(r), time.Unix(0, ft.Nanoseconds())
+}
+
 // PdhCounter defines a PDH counter object using a PDH path like: \PDH Category(PDH Instance)\PDH Counter
 type PdhCounter struct {
 	Path string
+
+	// Format selects which PdhGetFormattedCounterArray variant is used to read this
+	// counter's value: "double" (the default) or "long". There is no "large" option:
+	// PdhGetFormattedCounterArrayLarge's int64 value would still be handed to
+	// Prometheus as a float64 (the wire format MustNewConstMetric requires), so it
+	// cannot avoid the precision loss a naive double conversion already has above
+	// 2^53. The _raw metric, emitted only for Counter-type counters, is likewise
+	// converted to float64, so it does not carry exact values above 2^53 either.
+	Format string
+
+	// Include, when non-empty, restricts the instances emitted for this counter to
+	// those whose PDH instance name matches at least one of these regexes. Exclude
+	// drops any instance matching one of these regexes, applied after Include. Both
+	// guard against a wildcard path like \Process(*)\% Processor Time emitting
+	// thousands of series on a busy host.
+	Include []string
+	Exclude []string
+
+	// InstanceLabel overrides the label name used for this counter's instance, in
+	// place of the default "pdhinstance", matching the ergonomics of Telegraf's
+	// win_perf_counters plugin.
+	InstanceLabel string
 }
 
 // TestEquivalence will test if a is equal to p
 func (p *PdhCounter) TestEquivalence(a *PdhCounter) bool {
-	return p.Path == a.Path
+	return p.Path == a.Path && p.Format == a.Format && p.InstanceLabel == a.InstanceLabel &&
+		stringSlicesEqual(p.Include, a.Include) && stringSlicesEqual(p.Exclude, a.Exclude)
 }
 
-// PdhCounterSet defines a PdhCounter set to be collected on a single Host
+// stringSlicesEqual reports whether a and b contain the same strings in the same order.
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PdhCounterSet defines a PdhCounter set to be collected on a single Host. It
+// implements prometheus.Collector, querying the PDH API for fresh values each
+// time it is scraped instead of polling on its own interval. This removes the
+// race between a polling interval and Prometheus' scrape interval, and lets
+// counters whose set of instances changes over time (e.g. per-process) appear
+// and disappear naturally without ever needing to be re-registered.
 type PdhCounterSet struct {
-	completedInitialization bool // Indicates that the first iteration of StartCollect() has executed completely
-	Counters []PdhCounter // Contains all PdhCounter's to be collected
-	Done 	 chan struct{} // When this channel is closed, the collected Counters are unregistered from Prometheus and collection is stopped
-	Host     string // Defines the host to collect Counters from
-	Interval time.Duration // Defines the interval at which collection of Counters should be done
-	PdhQHandle win.PDH_HQUERY // A handle to the PDH Query used for collecting Counters
-	PdhCHandles map[string]*PdhCHandle // A handle to each PDH Counter
-	PromCollectors map[string]prometheus.Gauge // Contains a reference to all prometheus collectors that have been created
-	PromWaitGroup sync.WaitGroup // This is used to track if PromCollectors still contains active collectors
+	Counters           []PdhCounter           // Contains all PdhCounter's to be collected
+	Host               string                 // Defines the host to collect Counters from
+	PdhQHandle         win.PDH_HQUERY         // A handle to the PDH Query used for collecting Counters
+	PdhCHandles        map[string]*PdhCHandle // A handle to each PDH Counter
+	Registry           *prometheus.Registry   // The registry p is registered with, dedicated to this Host
+	UsePerfCounterTime bool                   // When true, metrics are emitted with the FILETIME PDH reports the sample was taken at, instead of scrape time
+	failedCollectors   *prometheus.Desc       // Describes the count of counters that failed to collect on a given scrape
+	failedToInit       int                    // Count of p.Counters that failed PdhValidatePath/PdhAddEnglishCounter in Open
+	warnedNoPerfTime   bool                   // Tracks whether the UsePerfCounterTime fallback warning has already been logged
+	collectMu          sync.Mutex             // Serializes Collect, since PdhCollectQueryData/PdhGetFormattedCounterArray* on PdhQHandle are not safe for concurrent use
 }
 
 // PdhCHandle links a PDH handle to the consecutive number of times it has been collected unsuccessfully
 type PdhCHandle struct {
-	handle *win.PDH_HCOUNTER
+	handle             *win.PDH_HCOUNTER
 	collectionFailures int
+	format             string               // Which PdhGetFormattedCounterArray variant to read this counter's value with
+	valueType          prometheus.ValueType // The Prometheus metric kind the _raw metric should be reported as; the formatted value is always a Gauge
+	instanceLabel      string               // The label name to report this counter's instance under
+	include            []*regexp.Regexp     // Instance must match at least one of these, if non-empty, to be emitted
+	exclude            []*regexp.Regexp     // Instance matching any of these is dropped, applied after include
 }
 
-// StopCollect shuts down the collection that was started by StartCollect()
-// and waits for all prometheus collectors to be unregistered.
-func (p *PdhCounterSet) StopCollect() {
-	// stop the old collection set
-	close(p.Done)
+// instanceAllowed reports whether instance passes h's include/exclude filters.
+func (h *PdhCHandle) instanceAllowed(instance string) bool {
+	if len(h.include) > 0 {
+		matched := false
+		for _, re := range h.include {
+			if re.MatchString(instance) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
 
-	// Wait until all Prometheus Collectors have been unregistered to prevent clashing with registration of the new Collectors
-	p.PromWaitGroup.Wait()
-}
+	for _, re := range h.exclude {
+		if re.MatchString(instance) {
+			return false
+		}
+	}
 
-// StartCollect will start the collection for the defined Host and Counters in p
-func (p *PdhCounterSet) StartCollect() error {
-	defer p.UnregisterPrometheusCollectors()
+	return true
+}
 
+// Open opens the PDH query for p, adds all of p.Counters to it, and registers p
+// with a new dedicated p.Registry. It must be called once before p is scraped.
+func (p *PdhCounterSet) Open() error {
 	log.WithFields(log.Fields{
 		"host": p.Host,
-	}).Info("start StartCollect()")
-
-	// Initialize basics of prometheus
-	p.PromCollectors = map[string]prometheus.Gauge{}
-	p.PromWaitGroup = sync.WaitGroup{}
+	}).Info("start Open()")
 
-	// Add a collector to track how many pdh counters fail to collect
-	g := prometheus.GaugeOpts{
-		ConstLabels:prometheus.Labels{"hostname":p.Host},
-		Help: "The number of counters that failed to initialize",
-		Name: "failed_collectors",
-		Namespace:"winpdh",
-	}
-	if err := p.AddPrometheusCollector("FailedCollectors", g); err != nil {
-		log.WithFields(log.Fields{
-			"host": p.Host,
-		}).Errorf("failed to add 'FailedCollectors' prometheus collector -> %s", err)
-		return err
-	}
+	p.failedCollectors = prometheus.NewDesc(
+		"winpdh_failed_collectors",
+		"The number of counters that failed to initialize at Open, plus counters that failed to collect on the last scrape",
+		nil,
+		prometheus.Labels{"hostname": p.Host},
+	)
 
 	p.PdhCHandles = map[string]*PdhCHandle{}
 
+	var failedToInit int
 	ret := win.PdhOpenQuery(0, 0, &p.PdhQHandle)
 	if ret != win.ERROR_SUCCESS {
 		log.WithFields(log.Fields{
-			"host": p.Host,
-			"PDHError": fmt.Sprintf("%x",ret),
+			"host":     p.Host,
+			"PDHError": fmt.Sprintf("%x", ret),
 		}).Error("failed PdhOpenQuery")
-	} else {
-		for _, c := range p.Counters {
-			counter := fmt.Sprintf("\\\\%s%s", p.Host, c.Path)
-			var c win.PDH_HCOUNTER
-			ret = win.PdhValidatePath(counter)
-			if ret == win.PDH_CSTATUS_BAD_COUNTERNAME {
+		return errors.New(fmt.Sprintf("failed PdhOpenQuery with PDH error code: %x", ret))
+	}
+
+	for _, c := range p.Counters {
+		counter := fmt.Sprintf("\\\\%s%s", p.Host, c.Path)
+		var h win.PDH_HCOUNTER
+		ret = win.PdhValidatePath(counter)
+		if ret == win.PDH_CSTATUS_BAD_COUNTERNAME {
+			log.WithFields(log.Fields{
+				"host":     p.Host,
+				"counter":  counter,
+				"PDHError": fmt.Sprintf("%x", ret),
+			}).Error("failed PdhValidatePath")
+			failedToInit++
+			continue
+		}
+
+		ret = win.PdhAddEnglishCounter(p.PdhQHandle, counter, 0, &h)
+		if ret != win.ERROR_SUCCESS {
+			if ret != win.PDH_CSTATUS_NO_OBJECT {
+				log.WithFields(log.Fields{
+					"counter":  counter,
+					"host":     p.Host,
+					"PDHError": fmt.Sprintf("%x", ret),
+				}).Error("failed PdhAddEnglishCounter")
+			} else {
+				log.WithFields(log.Fields{
+					"counter":  counter,
+					"host":     p.Host,
+					"PDHError": fmt.Sprintf("%x", ret),
+				}).Warn("failed PdhAddEnglishCounter, most likely because the counter doesn't exist.")
+			}
+			failedToInit++
+			continue
+		}
+
+		format := strings.ToLower(c.Format)
+		if format == "" {
+			format = "double"
+		}
+		instanceLabel := c.InstanceLabel
+		if instanceLabel == "" {
+			instanceLabel = "pdhinstance"
+		}
+		ch := &PdhCHandle{handle: &h, format: format, valueType: prometheus.GaugeValue, instanceLabel: instanceLabel}
+
+		for _, pattern := range c.Include {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
 				log.WithFields(log.Fields{
-					"host": p.Host,
 					"counter": counter,
-					"PDHError": fmt.Sprintf("%x",ret),
-				}).Error("failed PdhValidatePath")
-				p.PromCollectors["FailedCollectors"].Add(1)
+					"host":    p.Host,
+					"pattern": pattern,
+					"error":   err,
+				}).Error("failed to compile Include pattern")
 				continue
 			}
-
-			ret = win.PdhAddEnglishCounter(p.PdhQHandle, counter, 0, &c)
-			if ret != win.ERROR_SUCCESS {
-				if ret != win.PDH_CSTATUS_NO_OBJECT {
-					log.WithFields(log.Fields{
-						"counter": counter,
-						"host": p.Host,
-						"PDHError": fmt.Sprintf("%x",ret),
-					}).Error("failed PdhAddEnglishCounter")
-				} else {
-					log.WithFields(log.Fields{
-						"counter": counter,
-						"host": p.Host,
-						"PDHError": fmt.Sprintf("%x",ret),
-					}).Warn("failed PdhAddEnglishCounter, most likely because the counter doesn't exist.")
-				}
-				p.PromCollectors["FailedCollectors"].Add(1)
+			ch.include = append(ch.include, re)
+		}
+		for _, pattern := range c.Exclude {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"counter": counter,
+					"host":    p.Host,
+					"pattern": pattern,
+					"error":   err,
+				}).Error("failed to compile Exclude pattern")
 				continue
 			}
-
-			p.PdhCHandles[counter] = &PdhCHandle{handle: &c}
+			ch.exclude = append(ch.exclude, re)
 		}
 
-		ret = win.PdhCollectQueryData(p.PdhQHandle)
-		if ret != win.ERROR_SUCCESS {
-			// TODO: should I implement a custom error type here?
-			return errors.New(fmt.Sprintf("failed PdhCollectQueryData with PDH error code: %x", ret))
+		if info, err := pdhGetCounterInfo(h); err == nil {
+			ch.valueType = counterTypeToValueType(info.CounterType)
 		} else {
-			loop:
-			for {
-				ret := win.PdhCollectQueryData(p.PdhQHandle)
-				if ret == win.ERROR_SUCCESS {
-					for k, v := range p.PdhCHandles {
-						var bufSize uint32
-						var bufCount uint32
-						var size = uint32(unsafe.Sizeof(win.PDH_FMT_COUNTERVALUE_ITEM_DOUBLE{}))
-						var emptyBuf [1]win.PDH_FMT_COUNTERVALUE_ITEM_DOUBLE // need at least 1 addressable null ptr.
-
-						ret = win.PdhGetFormattedCounterArrayDouble(*v.handle, &bufSize, &bufCount, &emptyBuf[0])
-						if ret == win.PDH_MORE_DATA {
-							filledBuf := make([]win.PDH_FMT_COUNTERVALUE_ITEM_DOUBLE, bufCount*size)
-							ret = win.PdhGetFormattedCounterArrayDouble(*v.handle, &bufSize, &bufCount, &filledBuf[0])
-							if ret == win.ERROR_SUCCESS {
-								for i := 0; i < int(bufCount); i++ {
-									c := filledBuf[i]
-									s := win.UTF16PtrToString(c.SzName)
-
-									if val, ok := p.PromCollectors[k+s]; ok {
-										val.Set(c.FmtValue.DoubleValue)
-										v.collectionFailures = 0
-									} else {
-										if g, err := counterToPrometheusGauge(k, s); err == nil {
-											if err := p.AddPrometheusCollector(k+s, g); err != nil {
-												if e, ok := err.(prometheus.AlreadyRegisteredError); ok {
-													log.WithFields(log.Fields{
-														"counter": k,
-														"PDHInstance": s,
-														"host": p.Host,
-														"error": e,
-													}).Warnf("Collector already registered with prometheus")
-												} else {
-													log.WithFields(log.Fields{
-														"counter": k,
-														"PDHInstance": s,
-														"host": p.Host,
-														"error": err,
-													}).Error("failed to register with prometheus")
-													close(p.Done)
-													return err
-												}
-											} else {
-												log.WithFields(log.Fields{
-													"counter": k,
-													"PDHInstance": s,
-													"host": p.Host,
-												}).Debug("Collector registered with prometheus")
-											}
-										} else {
-											log.WithFields(log.Fields{
-												"counter": k,
-												"host": p.Host,
-												"error": err,
-											}).Error("failed counterToPrometheusGauge")
-										}
-									}
-								}
-							} else {
-								log.WithFields(log.Fields{
-									"counter": k,
-									"host": p.Host,
-									"PDHError": fmt.Sprintf("%x",ret),
-								}).Error("failed PdhGetFormattedCounterArrayDouble")
-								p.handleCollectionFailure(k, v, ret)
-							}
-						} else {
-							log.WithFields(log.Fields{
-								"counter": k,
-								"host": p.Host,
-							}).Warn("No data exists for counter.")
-							p.handleCollectionFailure(k, v, ret)
-						}
-					}
-				}
+			log.WithFields(log.Fields{
+				"counter": counter,
+				"host":    p.Host,
+				"error":   err,
+			}).Warn("failed PdhGetCounterInfo, defaulting to Gauge")
+		}
 
-				if !p.completedInitialization {
-					p.completedInitialization = true
-					log.WithFields(log.Fields{
-						"host": p.Host,
-					}).Info("completed StartCollect() initialization")
-				} else {
-					log.WithFields(log.Fields{
-						"host": p.Host,
-					}).Debug("completed StartCollect() iteration")
-				}
+		p.PdhCHandles[counter] = ch
+	}
 
-				select{
-				case <- p.Done:
-					log.WithFields(log.Fields{
-						"host": p.Host,
-					}).Info("instance Done channel was closed")
-					break loop // must specify name of loop or else it will just break out of select{}
-				case <- time.After(p.Interval):
-					// do nothing
-				}
-			}
-		}
+	if failedToInit > 0 {
+		log.WithFields(log.Fields{
+			"host":  p.Host,
+			"count": failedToInit,
+		}).Warn("one or more counters failed to be added to the PDH query")
+	}
+	p.failedToInit = failedToInit
+
+	p.Registry = prometheus.NewRegistry()
+	if err := p.Registry.Register(p); err != nil {
+		log.WithFields(log.Fields{
+			"host": p.Host,
+		}).Errorf("failed to register Prometheus collector -> %s", err)
+		return err
 	}
 
 	return nil
 }
 
-// AddPrometheusCollector adds a new gauge into PromCollectors and updates the number in PromWaitGroup
-func (p *PdhCounterSet) AddPrometheusCollector(key string, g prometheus.GaugeOpts) error {
-	p.PromCollectors[key] = prometheus.NewGauge(g)
-	if err := prometheus.Register(p.PromCollectors[key]); err != nil {
-		return err
-	} else {
-		p.PromWaitGroup.Add(1)
-		return nil
+// Handler returns an http.Handler that serves the metrics collected from p.Host,
+// backed by p's dedicated registry rather than prometheus.DefaultRegisterer. Mounting
+// this at a per-host path (e.g. /metrics/<host>) lets operators scrape a single host
+// without pulling metrics from every other host the exporter is collecting.
+func (p *PdhCounterSet) Handler() http.Handler {
+	return promhttp.HandlerFor(p.Registry, promhttp.HandlerOpts{})
+}
+
+// Close releases the PDH query opened by Open, invalidating all of p's counter handles.
+// It takes collectMu so it cannot race a Collect already in flight against the same
+// query handle, e.g. during a TestEquivalence-driven reconfiguration that closes the
+// old PdhCounterSet while its registry may still be serving a scrape.
+func (p *PdhCounterSet) Close() error {
+	p.collectMu.Lock()
+	defer p.collectMu.Unlock()
+
+	if ret := win.PdhCloseQuery(p.PdhQHandle); ret != win.ERROR_SUCCESS {
+		return errors.New(fmt.Sprintf("failed PdhCloseQuery with PDH error code: %x", ret))
 	}
+	return nil
 }
 
-// UnregisterPrometheusCollectors unregisters all prometheus collector instances in use by p
-func (p *PdhCounterSet) UnregisterPrometheusCollectors() {
-	for k, v := range p.PromCollectors {
-		if b := prometheus.Unregister(v); !b {
+// Describe implements prometheus.Collector. PdhCounterSet is an unchecked
+// collector: the set of series it emits depends on which PDH instances exist
+// at scrape time (e.g. running processes), so it cannot describe them all
+// ahead of time.
+func (p *PdhCounterSet) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect implements prometheus.Collector. It queries the PDH API for the
+// current value of every counter in p.PdhCHandles and emits each as a const
+// metric. A counter that fails to collect is reported via NewInvalidMetric
+// rather than silently dropped. Because collection now happens synchronously
+// on the scrape path rather than on a separate polling interval, there is no
+// stale Gauge left behind once a counter stops collecting, and no buffering
+// of samples between polls is needed.
+func (p *PdhCounterSet) Collect(ch chan<- prometheus.Metric) {
+	// PdhCollectQueryData/PdhGetFormattedCounterArray* are not documented as safe for
+	// concurrent use against the same PdhQHandle, and promhttp.HandlerFor can invoke
+	// Collect from more than one goroutine at once (overlapping scrapes, a retry
+	// racing a slow in-flight scrape), so serialize the whole method.
+	p.collectMu.Lock()
+	defer p.collectMu.Unlock()
+
+	var ret uint32
+	var sampleTime time.Time
+	haveSampleTime := false
+
+	if p.UsePerfCounterTime && pdhSupportsCollectQueryDataWithTime {
+		ret, sampleTime = pdhCollectQueryDataWithTime(p.PdhQHandle)
+		haveSampleTime = true
+	} else {
+		if p.UsePerfCounterTime && !p.warnedNoPerfTime {
 			log.WithFields(log.Fields{
-				"collector": k,
 				"host": p.Host,
-			}).Error("failed to unregister Prometheus Collector\n")
-		} else {
-			delete(p.PromCollectors, k)
-			p.PromWaitGroup.Done()
+			}).Warn("UsePerfCounterTime requires Windows Vista / Server 2008 or newer; falling back to scrape time")
+			p.warnedNoPerfTime = true
+		}
+		ret = win.PdhCollectQueryData(p.PdhQHandle)
+	}
+
+	if ret != win.ERROR_SUCCESS {
+		log.WithFields(log.Fields{
+			"host":     p.Host,
+			"PDHError": fmt.Sprintf("%x", ret),
+		}).Error("failed PdhCollectQueryData")
+		ch <- prometheus.NewInvalidMetric(p.failedCollectors, errors.New(fmt.Sprintf("failed PdhCollectQueryData with PDH error code: %x", ret)))
+		return
+	}
+
+	// emit stamps every metric produced in this Collect() call with the FILETIME PDH
+	// reported the sample was taken at, or leaves it as scrape time when unavailable.
+	emit := func(m prometheus.Metric) prometheus.Metric {
+		if haveSampleTime {
+			return prometheus.NewMetricWithTimestamp(sampleTime, m)
+		}
+		return m
+	}
+
+	var failed int
+	for k, v := range p.PdhCHandles {
+		values, err := readCounterValues(*v.handle, v.format)
+		if err != nil {
 			log.WithFields(log.Fields{
-				"collector": k,
-				"host": p.Host,
-			}).Debug("unregistered Prometheus Collector")
+				"counter": k,
+				"host":    p.Host,
+				"error":   err,
+			}).Error("failed to read counter values")
+			if desc, derr := counterToPrometheusDesc(k, "", v.instanceLabel); derr == nil {
+				ch <- prometheus.NewInvalidMetric(desc, err)
+			}
+			p.handleCollectionFailure(k, v, err)
+			failed++
+			continue
+		}
+		v.collectionFailures = 0
+
+		var filtered int
+		for _, cv := range values {
+			if !v.instanceAllowed(cv.instance) {
+				filtered++
+				continue
+			}
+
+			desc, err := counterToPrometheusDesc(k, cv.instance, v.instanceLabel)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"counter": k,
+					"host":    p.Host,
+					"error":   err,
+				}).Error("failed counterToPrometheusDesc")
+				continue
+			}
+
+			// The formatted value PDH hands back is already a computed, non-cumulative
+			// number (a rate for PERF_COUNTER_COUNTER/BULK_COUNT, an average for
+			// PERF_AVERAGE_*), so it is always reported as a Gauge even though
+			// v.valueType is CounterValue for the separate _raw metric emitted below.
+			ch <- emit(prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, cv.value))
+		}
+
+		if filteredDesc, err := counterToFilteredInstancesDesc(k); err == nil {
+			ch <- emit(prometheus.MustNewConstMetric(filteredDesc, prometheus.GaugeValue, float64(filtered)))
+		}
+
+		if v.valueType == prometheus.CounterValue {
+			rawValues, err := readCounterRawValues(*v.handle)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"counter": k,
+					"host":    p.Host,
+					"error":   err,
+				}).Warn("failed to read raw counter value")
+			} else {
+				for _, rv := range rawValues {
+					if !v.instanceAllowed(rv.instance) {
+						continue
+					}
+					desc, err := counterToPrometheusRawDesc(k, rv.instance, v.instanceLabel)
+					if err != nil {
+						continue
+					}
+					ch <- emit(prometheus.MustNewConstMetric(desc, prometheus.CounterValue, rv.value))
+				}
+			}
 		}
 	}
+
+	ch <- emit(prometheus.MustNewConstMetric(p.failedCollectors, prometheus.GaugeValue, float64(failed+p.failedToInit)))
 }
 
 // TestEquivalence will test if a is equivalent to p
 func (p *PdhCounterSet) TestEquivalence(a *PdhCounterSet) bool {
-	if p.Host != a.Host || p.Interval != a.Interval || len(p.Counters) != len(a.Counters) {
+	if p.Host != a.Host || p.UsePerfCounterTime != a.UsePerfCounterTime || len(p.Counters) != len(a.Counters) {
 		return false
 	}
 
@@ -278,25 +433,141 @@ func (p *PdhCounterSet) TestEquivalence(a *PdhCounterSet) bool {
 }
 
 // handleCollectionFailure is used to calculate when a counter should be deemed as non-collectible.
-func (p *PdhCounterSet) handleCollectionFailure(counter string, cHandle *PdhCHandle, ret uint32) {
+func (p *PdhCounterSet) handleCollectionFailure(counter string, cHandle *PdhCHandle, err error) {
 	cHandle.collectionFailures++
 
 	if cHandle.collectionFailures == 10 {
-		p.PromCollectors["FailedCollectors"].Add(1)
-
 		// stop collection of counter
 		delete(p.PdhCHandles, counter)
 
 		log.WithFields(log.Fields{
-			"counter":  counter,
-			"host":     p.Host,
-			"PDHError": fmt.Sprintf("%x",ret),
+			"counter": counter,
+			"host":    p.Host,
+			"error":   err,
 		}).Info("Stopping collection of counter due to 10 consecutive failed attempts.")
 	}
 }
 
-// counterToPrometheusGauge converts a windows performance counter string into
-// a prometheus Gauge.
+// counterValue is a single instance's value read back from a PDH counter handle.
+type counterValue struct {
+	instance string
+	value    float64
+}
+
+// readCounterValues reads the current value of every instance of hCounter using the
+// PdhGetFormattedCounterArray variant selected by format ("double", the default, or
+// "long").
+func readCounterValues(hCounter win.PDH_HCOUNTER, format string) ([]counterValue, error) {
+	switch format {
+	case "long":
+		return readCounterValuesLong(hCounter)
+	default:
+		return readCounterValuesDouble(hCounter)
+	}
+}
+
+func readCounterValuesDouble(hCounter win.PDH_HCOUNTER) ([]counterValue, error) {
+	var bufSize, bufCount uint32
+	var emptyBuf [1]win.PDH_FMT_COUNTERVALUE_ITEM_DOUBLE // need at least 1 addressable null ptr.
+	ret := win.PdhGetFormattedCounterArrayDouble(hCounter, &bufSize, &bufCount, &emptyBuf[0])
+	if ret != win.PDH_MORE_DATA {
+		return nil, errors.New(fmt.Sprintf("failed PdhGetFormattedCounterArrayDouble with PDH error code: %x", ret))
+	}
+
+	filledBuf := make([]win.PDH_FMT_COUNTERVALUE_ITEM_DOUBLE, bufCount)
+	if ret = win.PdhGetFormattedCounterArrayDouble(hCounter, &bufSize, &bufCount, &filledBuf[0]); ret != win.ERROR_SUCCESS {
+		return nil, errors.New(fmt.Sprintf("failed PdhGetFormattedCounterArrayDouble with PDH error code: %x", ret))
+	}
+
+	values := make([]counterValue, 0, bufCount)
+	for i := 0; i < int(bufCount); i++ {
+		c := filledBuf[i]
+		values = append(values, counterValue{instance: win.UTF16PtrToString(c.SzName), value: c.FmtValue.DoubleValue})
+	}
+	return values, nil
+}
+
+func readCounterValuesLong(hCounter win.PDH_HCOUNTER) ([]counterValue, error) {
+	var bufSize, bufCount uint32
+	var emptyBuf [1]win.PDH_FMT_COUNTERVALUE_ITEM_LONG
+	ret := win.PdhGetFormattedCounterArrayLong(hCounter, &bufSize, &bufCount, &emptyBuf[0])
+	if ret != win.PDH_MORE_DATA {
+		return nil, errors.New(fmt.Sprintf("failed PdhGetFormattedCounterArrayLong with PDH error code: %x", ret))
+	}
+
+	filledBuf := make([]win.PDH_FMT_COUNTERVALUE_ITEM_LONG, bufCount)
+	if ret = win.PdhGetFormattedCounterArrayLong(hCounter, &bufSize, &bufCount, &filledBuf[0]); ret != win.ERROR_SUCCESS {
+		return nil, errors.New(fmt.Sprintf("failed PdhGetFormattedCounterArrayLong with PDH error code: %x", ret))
+	}
+
+	values := make([]counterValue, 0, bufCount)
+	for i := 0; i < int(bufCount); i++ {
+		c := filledBuf[i]
+		values = append(values, counterValue{instance: win.UTF16PtrToString(c.SzName), value: float64(c.FmtValue.LongValue)})
+	}
+	return values, nil
+}
+
+// readCounterRawValues reads the raw, pre-formatting value PDH has cached for every
+// instance of hCounter. For Counter-type counters it is exposed alongside the formatted value so a
+// restarted exporter can recover a correct baseline for rate() without waiting on PDH.
+func readCounterRawValues(hCounter win.PDH_HCOUNTER) ([]counterValue, error) {
+	var bufSize, bufCount uint32
+	var emptyBuf [1]win.PDH_RAW_COUNTER_ITEM
+	ret := win.PdhGetRawCounterArray(hCounter, &bufSize, &bufCount, &emptyBuf[0])
+	if ret != win.PDH_MORE_DATA {
+		return nil, errors.New(fmt.Sprintf("failed PdhGetRawCounterArray with PDH error code: %x", ret))
+	}
+
+	filledBuf := make([]win.PDH_RAW_COUNTER_ITEM, bufCount)
+	if ret = win.PdhGetRawCounterArray(hCounter, &bufSize, &bufCount, &filledBuf[0]); ret != win.ERROR_SUCCESS {
+		return nil, errors.New(fmt.Sprintf("failed PdhGetRawCounterArray with PDH error code: %x", ret))
+	}
+
+	values := make([]counterValue, 0, bufCount)
+	for i := 0; i < int(bufCount); i++ {
+		c := filledBuf[i]
+		values = append(values, counterValue{instance: win.UTF16PtrToString(c.SzName), value: float64(c.RawValue.FirstValue)})
+	}
+	return values, nil
+}
+
+// pdhGetCounterInfo retrieves the PDH_COUNTER_INFO for hCounter, which exposes the
+// counter's raw CounterType so it can be mapped to the right Prometheus metric kind.
+func pdhGetCounterInfo(hCounter win.PDH_HCOUNTER) (*win.PDH_COUNTER_INFO, error) {
+	var bufSize uint32
+	ret := win.PdhGetCounterInfo(hCounter, 0, &bufSize, nil)
+	if ret != win.PDH_MORE_DATA {
+		return nil, errors.New(fmt.Sprintf("failed PdhGetCounterInfo with PDH error code: %x", ret))
+	}
+
+	buf := make([]byte, bufSize)
+	info := (*win.PDH_COUNTER_INFO)(unsafe.Pointer(&buf[0]))
+	if ret = win.PdhGetCounterInfo(hCounter, 0, &bufSize, info); ret != win.ERROR_SUCCESS {
+		return nil, errors.New(fmt.Sprintf("failed PdhGetCounterInfo with PDH error code: %x", ret))
+	}
+
+	return info, nil
+}
+
+// counterTypeToValueType maps a PDH counter's raw CounterType, as reported by
+// PdhGetCounterInfo, to the Prometheus metric kind its _raw value should be reported
+// as. Monotonically increasing "rate"/"bulk count" counters become a Counter so
+// rate() behaves correctly across exporter restarts; everything else (including
+// PERF_AVERAGE_* counters, whose formatted value is already an average rather than
+// a cumulative sum) remains a Gauge. The formatted value itself is always a Gauge
+// regardless of this mapping; see Collect.
+func counterTypeToValueType(counterType uint32) prometheus.ValueType {
+	switch counterType {
+	case win.PERF_COUNTER_COUNTER, win.PERF_COUNTER_BULK_COUNT, win.PERF_COUNTER_RAWCOUNT_HEX:
+		return prometheus.CounterValue
+	default:
+		return prometheus.GaugeValue
+	}
+}
+
+// counterToPrometheusDesc converts a windows performance counter string into
+// a prometheus.Desc.
 //
 // According to https://prometheus.io/docs/concepts/data_model/
 // 		- Prometheus Metric Names must match: [a-zA-Z_:][a-zA-Z0-9_:]*
@@ -305,12 +576,61 @@ func (p *PdhCounterSet) handleCollectionFailure(counter string, cHandle *PdhCHan
 //			- Label values: may contain any Unicode characters
 //
 // Additional Prometheus Metric/Label naming conventions: https://prometheus.io/docs/practices/naming/
-func counterToPrometheusGauge(counter, instance string) (prometheus.GaugeOpts, error) {
+func counterToPrometheusDesc(counter, instance, instanceLabel string) (*prometheus.Desc, error) {
+	return counterToPrometheusDescWithSuffix(counter, instance, instanceLabel, "")
+}
+
+// counterToPrometheusRawDesc is counterToPrometheusDesc, but names the metric with a
+// "_raw" suffix so the PDH-raw value can be exposed alongside the formatted one.
+func counterToPrometheusRawDesc(counter, instance, instanceLabel string) (*prometheus.Desc, error) {
+	return counterToPrometheusDescWithSuffix(counter, instance, instanceLabel, "_raw")
+}
+
+// counterToFilteredInstancesDesc describes the per-counter "how many instances did
+// Include/Exclude drop" metric, so operators can tell when their regexes are dropping
+// data unexpectedly.
+func counterToFilteredInstancesDesc(counter string) (*prometheus.Desc, error) {
+	hostname, category, counterName, _, err := parseCounterPath(counter, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return prometheus.NewDesc(
+		prometheus.BuildFQName("winpdh", "", "filtered_instances"),
+		"The number of instances of this counter dropped by Include/Exclude filters on the last scrape",
+		nil,
+		prometheus.Labels{"hostname": hostname, "pdhcategory": category, "pdhcounter": counterName},
+	), nil
+}
+
+func counterToPrometheusDescWithSuffix(counter, instance, instanceLabel, suffix string) (*prometheus.Desc, error) {
+	hostname, category, counterName, instance, err := parseCounterPath(counter, instance)
+	if err != nil {
+		return nil, err
+	}
+	instance, err = sanitizeLabelValue(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	return prometheus.NewDesc(
+		prometheus.BuildFQName("winpdh", "", counterName+suffix),
+		"windows performance counter",
+		nil,
+		prometheus.Labels{"hostname": hostname, "pdhcategory": category, instanceLabel: instance},
+	), nil
+}
+
+// parseCounterPath splits a fully-qualified PDH counter path (as built in Open, of the
+// form \\host\Category(Instance)\Counter) into its hostname, category, and counter name,
+// sanitizing the category and counter name for use as Prometheus label/metric values. If
+// the category names a specific instance rather than "*", that instance overrides the one
+// passed in and is returned unsanitized (the caller sanitizes it, since callers that don't
+// need it can skip that work).
+func parseCounterPath(counter, instance string) (hostname, category, counterName, resolvedInstance string, err error) {
 	fields := strings.Split(counter, "\\")
-	var hostname string
 	var catIndex int
 	var valIndex int
-	var category string
 
 	// If the string contains a hostname
 	if len(fields) == 5 {
@@ -322,7 +642,7 @@ func counterToPrometheusGauge(counter, instance string) (prometheus.GaugeOpts, e
 		catIndex = 1
 		valIndex = 2
 	} else {
-		return prometheus.GaugeOpts{}, errors.New("Unknown number of fields in counter: " + counter)
+		return "", "", "", "", errors.New("Unknown number of fields in counter: " + counter)
 	}
 
 	if strings.Contains(fields[catIndex], "(") {
@@ -336,30 +656,36 @@ func counterToPrometheusGauge(counter, instance string) (prometheus.GaugeOpts, e
 		category = fields[catIndex]
 	}
 
-	// Replace known runes that occur in winpdh
+	category, err = sanitizeLabelValue(category)
+	if err != nil {
+		return "", "", "", "", err
+	}
+
+	counterName, err = sanitizeLabelValue(fields[valIndex])
+	if err != nil {
+		return "", "", "", "", err
+	}
+
+	return hostname, category, counterName, instance, nil
+}
+
+// sanitizeLabelValue replaces known runes that occur in winpdh counter/instance names
+// with underscores (or "percent" for "%"), then strips every remaining rune outside
+// [a-zA-Z0-9_:].
+func sanitizeLabelValue(s string) (string, error) {
 	r := strings.NewReplacer(
 		".", "_",
 		"-", "_",
 		" ", "_",
-		"/","_",
+		"/", "_",
 		"%", "percent",
 	)
-	counterName := r.Replace(fields[valIndex])
-	instance = r.Replace(instance)
+	s = r.Replace(s)
 
-	// Use this regex to replace any invalid characters that weren't accounted for already
 	reg, err := regexp.Compile("[^a-zA-Z0-9_:]")
 	if err != nil {
-		return prometheus.GaugeOpts{}, err
+		return "", err
 	}
 
-	category = string(reg.ReplaceAll([]byte(category),[]byte("")))
-	instance = string(reg.ReplaceAll([]byte(instance),[]byte("")))
-
-	return prometheus.GaugeOpts{
-		ConstLabels: prometheus.Labels{"hostname": hostname, "pdhcategory": category, "pdhinstance": instance},
-		Help: "windows performance counter",
-		Name: string(reg.ReplaceAll([]byte(counterName),[]byte(""))),
-		Namespace:"winpdh",
-	}, nil
-}
\ No newline at end of file
+	return string(reg.ReplaceAll([]byte(s), []byte(""))), nil
+}
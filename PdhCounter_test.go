@@ -0,0 +1,192 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/lxn/win"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPdhCHandleInstanceAllowed(t *testing.T) {
+	mustCompile := func(patterns ...string) []*regexp.Regexp {
+		res := make([]*regexp.Regexp, len(patterns))
+		for i, p := range patterns {
+			res[i] = regexp.MustCompile(p)
+		}
+		return res
+	}
+
+	tests := []struct {
+		name     string
+		include  []*regexp.Regexp
+		exclude  []*regexp.Regexp
+		instance string
+		want     bool
+	}{
+		{name: "no filters allows everything", instance: "chrome", want: true},
+		{name: "include match passes", include: mustCompile("^chrome"), instance: "chrome#1", want: true},
+		{name: "include mismatch is dropped", include: mustCompile("^chrome"), instance: "firefox", want: false},
+		{name: "exclude match is dropped", exclude: mustCompile("^_Total$"), instance: "_Total", want: false},
+		{name: "exclude mismatch passes", exclude: mustCompile("^_Total$"), instance: "chrome", want: true},
+		{name: "exclude applied after include", include: mustCompile(".*"), exclude: mustCompile("^_Total$"), instance: "_Total", want: false},
+		{name: "instance with regex metacharacters", include: mustCompile(`^Processor\(_Total\)$`), instance: "Processor(_Total)", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &PdhCHandle{include: tt.include, exclude: tt.exclude}
+			if got := h.instanceAllowed(tt.instance); got != tt.want {
+				t.Errorf("instanceAllowed(%q) = %v, want %v", tt.instance, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCounterPath(t *testing.T) {
+	tests := []struct {
+		name             string
+		counter          string
+		instance         string
+		wantHostname     string
+		wantCategory     string
+		wantCounterName  string
+		wantInstanceName string
+		wantErr          bool
+	}{
+		{
+			name:             "host-qualified path with instance",
+			counter:          `\\SOMEHOST\Process(chrome)\% Processor Time`,
+			wantHostname:     "SOMEHOST",
+			wantCategory:     "Process",
+			wantCounterName:  "percent_Processor_Time",
+			wantInstanceName: "chrome",
+		},
+		{
+			name:             "host-qualified path with wildcard instance keeps the passed-in instance",
+			counter:          `\\SOMEHOST\Process(*)\% Processor Time`,
+			instance:         "chrome",
+			wantHostname:     "SOMEHOST",
+			wantCategory:     "Process",
+			wantCounterName:  "percent_Processor_Time",
+			wantInstanceName: "chrome",
+		},
+		{
+			name:             "unqualified path defaults hostname to localhost",
+			counter:          `\Processor(_Total)\% Processor Time`,
+			wantHostname:     "localhost",
+			wantCategory:     "Processor",
+			wantCounterName:  "percent_Processor_Time",
+			wantInstanceName: "_Total",
+		},
+		{
+			name:            "category without an instance",
+			counter:         `\Memory\Available Bytes`,
+			wantHostname:    "localhost",
+			wantCategory:    "Memory",
+			wantCounterName: "Available_Bytes",
+		},
+		{
+			name:    "unrecognized number of fields",
+			counter: `\Memory\Available Bytes\Extra`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostname, category, counterName, instance, err := parseCounterPath(tt.counter, tt.instance)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCounterPath(%q) expected an error, got none", tt.counter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCounterPath(%q) unexpected error: %v", tt.counter, err)
+			}
+			if hostname != tt.wantHostname {
+				t.Errorf("hostname = %q, want %q", hostname, tt.wantHostname)
+			}
+			if category != tt.wantCategory {
+				t.Errorf("category = %q, want %q", category, tt.wantCategory)
+			}
+			if counterName != tt.wantCounterName {
+				t.Errorf("counterName = %q, want %q", counterName, tt.wantCounterName)
+			}
+			if instance != tt.wantInstanceName {
+				t.Errorf("instance = %q, want %q", instance, tt.wantInstanceName)
+			}
+		})
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "empty string", in: "", want: ""},
+		{name: "already valid", in: "pdhinstance", want: "pdhinstance"},
+		{name: "percent becomes percent", in: "% Processor Time", want: "percent_Processor_Time"},
+		{name: "dots dashes spaces slashes become underscores", in: "foo.bar-baz qux/quux", want: "foo_bar_baz_qux_quux"},
+		{name: "other punctuation is stripped, not underscored", in: "a(b)c#d", want: "abcd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeLabelValue(tt.in)
+			if err != nil {
+				t.Fatalf("sanitizeLabelValue(%q) unexpected error: %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeLabelValue(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringSlicesEqual(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want bool
+	}{
+		{name: "both nil", want: true},
+		{name: "both empty", a: []string{}, b: []string{}, want: true},
+		{name: "equal contents", a: []string{"a", "b"}, b: []string{"a", "b"}, want: true},
+		{name: "different lengths", a: []string{"a"}, b: []string{"a", "b"}, want: false},
+		{name: "different order", a: []string{"a", "b"}, b: []string{"b", "a"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringSlicesEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("stringSlicesEqual(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterTypeToValueType(t *testing.T) {
+	tests := []struct {
+		name        string
+		counterType uint32
+		want        prometheus.ValueType
+	}{
+		{name: "PERF_COUNTER_COUNTER is a Counter", counterType: win.PERF_COUNTER_COUNTER, want: prometheus.CounterValue},
+		{name: "PERF_COUNTER_BULK_COUNT is a Counter", counterType: win.PERF_COUNTER_BULK_COUNT, want: prometheus.CounterValue},
+		{name: "PERF_COUNTER_RAWCOUNT_HEX is a Counter", counterType: win.PERF_COUNTER_RAWCOUNT_HEX, want: prometheus.CounterValue},
+		{name: "PERF_AVERAGE_BULK is a Gauge", counterType: win.PERF_AVERAGE_BULK, want: prometheus.GaugeValue},
+		{name: "unknown counter type defaults to Gauge", counterType: 0xDEADBEEF, want: prometheus.GaugeValue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := counterTypeToValueType(tt.counterType); got != tt.want {
+				t.Errorf("counterTypeToValueType(%x) = %v, want %v", tt.counterType, got, tt.want)
+			}
+		})
+	}
+}